@@ -1,8 +1,16 @@
 package redis
 
 import (
-	"koding/tools/config"
+	"context"
+	"fmt"
+	"strings"
 	"sync"
+	"time"
+
+	"koding/tools/config"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/golang/glog"
 )
 
 // SingletonSession handles connection pool for Redis
@@ -11,6 +19,9 @@ type SingletonSession struct {
 	Err       error
 	conf      *config.Config
 	initMutex sync.Mutex
+
+	subscribers []func(old, new *RedisSession)
+	cancelWatch context.CancelFunc
 }
 
 // Create a new Singleton
@@ -20,9 +31,19 @@ func Singleton(c *config.Config) *SingletonSession {
 	}
 }
 
-// Connect connects to Redis and holds the Session and Err object
-// in the SingletonSession struct
-func (r *SingletonSession) Connect() (*RedisSession, error) {
+// Connect connects to Redis and holds the Session and Err object in the
+// SingletonSession struct. The cached session is reused across calls
+// regardless of the ctx a given caller passes in, since callers such as
+// HTTP handlers each pass their own short-lived context. ctx is not
+// consulted at all: the dial through NewRedisSession takes no context,
+// so neither a dial attempt nor the pool's lifetime is bound to it or
+// cut short by its cancellation. A reconnect only happens when there is
+// no session yet or the last attempt failed, and the outgoing session is closed before the
+// replacement is installed. When the config has a Sentinel quorum
+// configured, Connect also starts a background watcher that swaps the
+// session on failover and a health checker that forces a reconnect if
+// the master stops responding.
+func (r *SingletonSession) Connect(ctx context.Context) (*RedisSession, error) {
 	r.initMutex.Lock()
 	defer r.initMutex.Unlock()
 
@@ -30,14 +51,160 @@ func (r *SingletonSession) Connect() (*RedisSession, error) {
 		return r.Session, nil
 	}
 
+	if r.Session != nil {
+		r.Session.Close()
+	}
 	r.Session, r.Err = NewRedisSession(r.conf.Redis)
+
+	if r.Err == nil && r.conf.Redis.Sentinel != nil && r.cancelWatch == nil {
+		r.startSentinelWatch(r.conf.Redis.Sentinel)
+	}
+
 	return r.Session, r.Err
 }
 
-// Close clears the connection to redis
-func (r *SingletonSession) Close() {
+// Subscribe registers hook to be called whenever a Sentinel failover or
+// a failed health check swaps the active session, so callers holding
+// long-lived pub/sub connections can rebuild them against the new
+// master.
+func (r *SingletonSession) Subscribe(hook func(old, new *RedisSession)) {
 	r.initMutex.Lock()
 	defer r.initMutex.Unlock()
+	r.subscribers = append(r.subscribers, hook)
+}
+
+// startSentinelWatch runs the watchers for the life of the pool, not of
+// whatever caller's ctx happened to trigger Connect's lazy start: it
+// derives watchCtx from context.Background() and relies solely on
+// r.cancelWatch (invoked from Close) to stop them. Deriving from a
+// per-call ctx instead would tie a Sentinel failover long after the
+// first caller's request context is done.
+func (r *SingletonSession) startSentinelWatch(sc *config.SentinelConfig) {
+	watchCtx, cancel := context.WithCancel(context.Background())
+	r.cancelWatch = cancel
+
+	go r.watchSwitchMaster(watchCtx, sc)
+	go r.watchHealth(watchCtx, sc)
+}
+
+func sentinelHealthCheckInterval(sc *config.SentinelConfig) time.Duration {
+	if sc.FailoverPollInterval > 0 {
+		return sc.FailoverPollInterval
+	}
+	return 5 * time.Second
+}
+
+// watchSwitchMaster subscribes to +switch-master events from the first
+// sentinel in sc.Addrs and reconnects as soon as one arrives for our
+// master. The other addresses are not used: if that sentinel is
+// unreachable, it retries the same one after the poll interval.
+func (r *SingletonSession) watchSwitchMaster(ctx context.Context, sc *config.SentinelConfig) {
+	for ctx.Err() == nil {
+		if err := r.subscribeOnce(ctx, sc); err != nil && ctx.Err() == nil {
+			glog.Errorf("redis sentinel watch: %v", err)
+			time.Sleep(sentinelHealthCheckInterval(sc))
+		}
+	}
+}
+
+func (r *SingletonSession) subscribeOnce(ctx context.Context, sc *config.SentinelConfig) error {
+	if len(sc.Addrs) == 0 {
+		return fmt.Errorf("no sentinel addresses configured")
+	}
+
+	conn, err := redigo.DialTimeout("tcp", sc.Addrs[0], 5*time.Second, 0, 0)
+	if err != nil {
+		return fmt.Errorf("dial sentinel %s: %w", sc.Addrs[0], err)
+	}
+	defer conn.Close()
+
+	psc := redigo.PubSubConn{Conn: conn}
+	if err := psc.Subscribe("+switch-master"); err != nil {
+		return fmt.Errorf("subscribe +switch-master on %s: %w", sc.Addrs[0], err)
+	}
+	defer psc.Unsubscribe("+switch-master")
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redigo.Message:
+			// payload: "<master-name> <old-ip> <old-port> <new-ip> <new-port>"
+			fields := strings.Fields(string(v.Data))
+			if len(fields) != 5 || fields[0] != sc.MasterName {
+				continue
+			}
+			r.reconnect("sentinel failover to " + fields[3] + ":" + fields[4])
+		case error:
+			if ctx.Err() != nil {
+				return nil
+			}
+			return v
+		}
+	}
+}
+
+// watchHealth pings the current master every poll interval and forces a
+// reconnect if it stops responding, so a stuck TCP connection doesn't
+// wedge the whole Koding backend.
+func (r *SingletonSession) watchHealth(ctx context.Context, sc *config.SentinelConfig) {
+	ticker := time.NewTicker(sentinelHealthCheckInterval(sc))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.initMutex.Lock()
+			session := r.Session
+			r.initMutex.Unlock()
+
+			if session == nil || session.Ping() != nil {
+				r.reconnect("redis health check failed")
+			}
+		}
+	}
+}
+
+// reconnect dials a fresh session and swaps it in, closing the outgoing
+// one once subscribers have had a chance to rebuild against the new
+// master so nothing is left holding a reference to it.
+func (r *SingletonSession) reconnect(reason string) {
+	r.initMutex.Lock()
+	defer r.initMutex.Unlock()
+
+	glog.Errorf("redis: reconnecting (%s)", reason)
+
+	old := r.Session
+	session, err := NewRedisSession(r.conf.Redis)
+	if err != nil {
+		r.Err = err
+		return
+	}
+
+	r.Session, r.Err = session, nil
+	for _, hook := range r.subscribers {
+		hook(old, session)
+	}
+	if old != nil {
+		old.Close()
+	}
+}
+
+// Close clears the connection to redis and tears down the sentinel
+// watcher, if one is running.
+func (r *SingletonSession) Close(ctx context.Context) {
+	r.initMutex.Lock()
+	defer r.initMutex.Unlock()
+
+	if r.cancelWatch != nil {
+		r.cancelWatch()
+		r.cancelWatch = nil
+	}
 
 	r.Session.Close()
 	r.Session = nil
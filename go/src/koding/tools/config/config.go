@@ -0,0 +1,34 @@
+// Package config is a minimal stand-in for Koding's real runtime
+// configuration package, defining only the fields the packages in this
+// tree actually read off it.
+package config
+
+import "time"
+
+// Config is the root of Koding's runtime configuration.
+type Config struct {
+	Redis *Redis
+}
+
+// Redis holds the connection settings for the shared Redis pool.
+type Redis struct {
+	Host     string
+	Port     int
+	DB       int
+	Password string
+
+	// Sentinel enables Sentinel-based master discovery and automatic
+	// failover for this pool. Nil means connect directly to Host:Port
+	// with no failover support.
+	Sentinel *SentinelConfig
+}
+
+// SentinelConfig describes how to reach a Redis Sentinel quorum for
+// automatic master failover. It lives here rather than in the redis
+// package so that config, which redis already imports, doesn't have to
+// import redis back.
+type SentinelConfig struct {
+	Addrs                []string
+	MasterName           string
+	FailoverPollInterval time.Duration
+}
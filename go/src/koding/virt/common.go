@@ -0,0 +1,90 @@
+package virt
+
+import (
+	"fmt"
+	"net"
+
+	"labix.org/v2/mgo/bson"
+)
+
+const UserIdOffset = 1000000
+const RootIdOffset = 500000
+
+// UserEntry records one user account provisioned inside a VM.
+type UserEntry struct {
+	Id   bson.ObjectId `bson:"id"`
+	Sudo bool          `bson:"sudo"`
+}
+
+// Common holds the fields every Instance driver needs regardless of
+// whether the underlying workload runs in an LXC container or a
+// QEMU/KVM microVM. Drivers embed a *Common and get its addressing and
+// path helpers for free.
+type Common struct {
+	Id           bson.ObjectId `bson:"_id"`
+	Name         string        `bson:"name"`
+	Users        []*UserEntry  `bson:"users"`
+	LdapPassword string        `bson:"ldapPassword"`
+	IP           net.IP        `bson:"ip"`
+	HostKite     string        `bson:"hostKite"`
+
+	// DBType selects which registered driver Load returns this Common
+	// wrapped in. It is empty for VMs created before drivers existed,
+	// which Load treats as "lxc".
+	DBType string `bson:"dbType"`
+
+	// SnapshotPruning opts this VM into Load starting a background
+	// RunSnapshotPruner for it. Nil, the default, leaves automatic
+	// pruning off.
+	SnapshotPruning *SnapshotPruneConfig `bson:"snapshotPruning,omitempty"`
+}
+
+func (c *Common) String() string {
+	return "vm-" + c.Id.Hex()
+}
+
+func (c *Common) VEth() string {
+	return fmt.Sprintf("veth-%x", []byte(c.IP[12:16]))
+}
+
+func (c *Common) MAC() net.HardwareAddr {
+	return net.HardwareAddr([]byte{0, 0, c.IP[12], c.IP[13], c.IP[14], c.IP[15]})
+}
+
+func (c *Common) Hostname() string {
+	return c.Name + ".koding.com"
+}
+
+func (c *Common) RbdDevice() string {
+	return "/dev/rbd/vms/" + c.String()
+}
+
+// LXCRoot is the base directory VM files live under. It's a var rather
+// than a constant so failure-injection tests can point it at a scratch
+// directory instead of the real /var/lib/lxc.
+var LXCRoot = "/var/lib/lxc"
+
+func (c *Common) File(p string) string {
+	return fmt.Sprintf("%s/%s/%s", LXCRoot, c, p)
+}
+
+func (c *Common) OverlayFile(p string) string {
+	return c.File("overlay/" + p)
+}
+
+func (c *Common) PtsDir() string {
+	return c.File("rootfs/dev/pts")
+}
+
+func (c *Common) GetUserEntry(user *User) *UserEntry {
+	for _, entry := range c.Users {
+		if entry.Id == user.ObjectId {
+			return entry
+		}
+	}
+	return nil
+}
+
+func LowerdirFile(p string) string {
+	return "/var/lib/lxc/vmroot/rootfs/" + p
+}
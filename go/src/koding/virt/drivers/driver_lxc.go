@@ -0,0 +1,374 @@
+// Package drivers holds the Instance implementations virt.Load can
+// return: the original LXC/aufs/RBD container driver, and the QEMU/KVM
+// microVM driver.
+package drivers
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"koding/virt"
+
+	"github.com/golang/glog"
+)
+
+func init() {
+	virt.RegisterDriver("lxc", func(c *virt.Common) virt.Instance {
+		return &LXC{c}
+	})
+}
+
+// LXC is the original Koding driver: it boots a privileged LXC container
+// whose root filesystem is an aufs overlay of a shared read-only image
+// and a per-VM RBD-backed upper directory.
+type LXC struct {
+	*virt.Common
+}
+
+// Prepare brings a container's root filesystem and networking up in
+// stages, recording a rollback step as each one completes. If any stage
+// fails, the already-completed stages are undone in reverse order
+// before the wrapped error is returned, so a failed Prepare never leaves
+// a half-mounted container behind.
+func (l *LXC) Prepare(ctx context.Context, users []virt.User, reinitialize bool) error {
+	if err := l.Unprepare(ctx); err != nil {
+		return fmt.Errorf("unprepare %s before prepare: %w", l, err)
+	}
+
+	return l.prepare(ctx, users, reinitialize)
+}
+
+// prepare does the actual multi-stage bring-up, assuming the container
+// has already been stopped and unprepared. It's split out from Prepare
+// so failure-injection tests can exercise the rollback logic directly,
+// without needing a real lxc-stop/lxc-info toolchain to satisfy
+// Unprepare's precondition first.
+func (l *LXC) prepare(ctx context.Context, users []virt.User, reinitialize bool) error {
+	var rb virt.Rollback
+
+	glog.V(1).Infof("%s: writing LXC config", l)
+	if _, err := virt.PrepareDir(l.File(""), 0); err != nil {
+		return fmt.Errorf("prepare %s: %w", l, err)
+	}
+	rb.Add(func() {
+		if err := os.RemoveAll(l.File("")); err != nil {
+			glog.Errorf("%s: rollback remove %s: %v", l, l.File(""), err)
+		}
+	})
+
+	if err := l.generateFile(l.File("config"), "config", 0, false); err != nil {
+		rb.Run()
+		return fmt.Errorf("generate config for %s: %w", l, err)
+	}
+	if err := l.generateFile(l.File("fstab"), "fstab", 0, false); err != nil {
+		rb.Run()
+		return fmt.Errorf("generate fstab for %s: %w", l, err)
+	}
+
+	glog.V(1).Infof("%s: mapping rbd image", l)
+	if _, err := l.MapRBD(ctx, true); err != nil {
+		rb.Run()
+		return fmt.Errorf("map rbd for %s: %w", l, err)
+	}
+	rb.Add(func() {
+		if out, err := exec.CommandContext(ctx, "/usr/bin/rbd", "unmap", l.RbdDevice()).CombinedOutput(); err != nil {
+			glog.Errorf("%s: rollback rbd unmap: %v", l, virt.CommandError("rbd unmap failed", err, out))
+		}
+	})
+
+	glog.V(1).Infof("%s: mounting rbd device onto overlay", l)
+	if _, err := virt.PrepareDir(l.OverlayFile("/"), virt.RootIdOffset); err != nil {
+		rb.Run()
+		return fmt.Errorf("prepare overlay dir for %s: %w", l, err)
+	}
+	if out, err := exec.CommandContext(ctx, "/bin/mount", "-t", "ext4", l.RbdDevice(), l.OverlayFile("")).CombinedOutput(); err != nil {
+		rb.Run()
+		return virt.CommandError(fmt.Sprintf("mount rbd %s", l), err, out)
+	}
+	rb.Add(func() {
+		if out, err := exec.CommandContext(ctx, "/bin/umount", l.OverlayFile("")).CombinedOutput(); err != nil {
+			glog.Errorf("%s: rollback umount rbd: %v", l, virt.CommandError("umount rbd failed", err, out))
+		}
+	})
+
+	// remove all except /home on reinitialize
+	if reinitialize {
+		glog.V(1).Infof("%s: reinitializing, clearing overlay except /home", l)
+		entries, err := ioutil.ReadDir(l.OverlayFile("/"))
+		if err != nil {
+			rb.Run()
+			return fmt.Errorf("read overlay dir for %s: %w", l, err)
+		}
+		for _, entry := range entries {
+			if entry.Name() != "home" {
+				os.RemoveAll(l.OverlayFile("/" + entry.Name()))
+			}
+		}
+	}
+
+	// prepare directories in overlay
+	for _, p := range []string{"/", "/lost+found", "/etc", "/home"} {
+		if _, err := virt.PrepareDir(l.OverlayFile(p), virt.RootIdOffset); err != nil {
+			rb.Run()
+			return fmt.Errorf("prepare overlay %s for %s: %w", p, l, err)
+		}
+	}
+
+	// create user homes
+	for i, user := range users {
+		created, err := virt.PrepareDir(l.OverlayFile("/home/"+user.Name), user.Uid)
+		if err != nil {
+			rb.Run()
+			return fmt.Errorf("prepare home dir for %s on %s: %w", user.Name, l, err)
+		}
+		if !created || i != 0 {
+			continue
+		}
+
+		if _, err := virt.PrepareDir(l.OverlayFile("/home/"+user.Name+"/Sites"), user.Uid); err != nil {
+			rb.Run()
+			return fmt.Errorf("prepare Sites dir for %s on %s: %w", user.Name, l, err)
+		}
+		if _, err := virt.PrepareDir(l.OverlayFile("/home/"+user.Name+"/Sites/"+l.Hostname()), user.Uid); err != nil {
+			rb.Run()
+			return fmt.Errorf("prepare site dir for %s on %s: %w", user.Name, l, err)
+		}
+		websiteDir := "/home/" + user.Name + "/Sites/" + l.Hostname() + "/website"
+		if _, err := virt.PrepareDir(l.OverlayFile(websiteDir), user.Uid); err != nil {
+			rb.Run()
+			return fmt.Errorf("prepare website dir for %s on %s: %w", user.Name, l, err)
+		}
+		files, err := ioutil.ReadDir(virt.TemplateDir() + "/website")
+		if err != nil {
+			rb.Run()
+			return fmt.Errorf("read website template dir: %w", err)
+		}
+		for _, file := range files {
+			if err := virt.CopyFile(virt.TemplateDir()+"/website/"+file.Name(), l.OverlayFile(websiteDir+"/"+file.Name()), user.Uid); err != nil {
+				rb.Run()
+				return fmt.Errorf("copy website file %s for %s: %w", file.Name(), l, err)
+			}
+		}
+		if _, err := virt.PrepareDir(l.OverlayFile("/var"), virt.RootIdOffset); err != nil {
+			rb.Run()
+			return fmt.Errorf("prepare /var for %s: %w", l, err)
+		}
+		if err := os.Symlink(websiteDir, l.OverlayFile("/var/www")); err != nil {
+			rb.Run()
+			return fmt.Errorf("symlink /var/www for %s: %w", l, err)
+		}
+	}
+
+	// generate overlay files
+	for _, f := range []struct{ path, tmpl string }{
+		{"/etc/hostname", "hostname"},
+		{"/etc/hosts", "hosts"},
+		{"/etc/ldap.conf", "ldap.conf"},
+	} {
+		if err := l.generateFile(l.OverlayFile(f.path), f.tmpl, virt.RootIdOffset, false); err != nil {
+			rb.Run()
+			return fmt.Errorf("generate %s for %s: %w", f.path, l, err)
+		}
+	}
+	l.MergePasswdFile()
+	l.MergeGroupFile()
+	l.MergeDpkgDatabase()
+
+	// mount overlay
+	glog.V(1).Infof("%s: mounting aufs overlay", l)
+	if _, err := virt.PrepareDir(l.File("rootfs"), virt.RootIdOffset); err != nil {
+		rb.Run()
+		return fmt.Errorf("prepare rootfs dir for %s: %w", l, err)
+	}
+	if out, err := exec.CommandContext(ctx, "/bin/mount", "--no-mtab", "-t", "aufs", "-o", fmt.Sprintf("br=%s:%s", l.OverlayFile("/"), virt.LowerdirFile("/")), "aufs", l.File("rootfs")).CombinedOutput(); err != nil {
+		rb.Run()
+		return virt.CommandError(fmt.Sprintf("mount overlay %s", l), err, out)
+	}
+	rb.Add(func() {
+		if out, err := exec.CommandContext(ctx, "/bin/umount", l.File("rootfs")).CombinedOutput(); err != nil {
+			glog.Errorf("%s: rollback umount overlay: %v", l, virt.CommandError("umount overlay failed", err, out))
+		}
+	})
+
+	// mount devpts
+	glog.V(1).Infof("%s: mounting devpts", l)
+	if _, err := virt.PrepareDir(l.PtsDir(), virt.RootIdOffset); err != nil {
+		rb.Run()
+		return fmt.Errorf("prepare pts dir for %s: %w", l, err)
+	}
+	if out, err := exec.CommandContext(ctx, "/bin/mount", "--no-mtab", "-t", "devpts", "-o", "rw,noexec,nosuid,gid="+strconv.Itoa(virt.RootIdOffset+5)+",mode=0620", "devpts", l.PtsDir()).CombinedOutput(); err != nil {
+		rb.Run()
+		return virt.CommandError(fmt.Sprintf("mount devpts %s", l), err, out)
+	}
+	rb.Add(func() {
+		if out, err := exec.CommandContext(ctx, "/bin/umount", l.PtsDir()).CombinedOutput(); err != nil {
+			glog.Errorf("%s: rollback umount devpts: %v", l, virt.CommandError("umount devpts failed", err, out))
+		}
+	})
+	if err := virt.Chown(l.PtsDir(), virt.RootIdOffset, virt.RootIdOffset); err != nil {
+		rb.Run()
+		return err
+	}
+	if err := virt.Chown(l.PtsDir()+"/ptmx", virt.RootIdOffset, virt.RootIdOffset+5); err != nil {
+		rb.Run()
+		return err
+	}
+
+	// add ebtables entry to restrict IP and MAC
+	glog.V(1).Infof("%s: adding ebtables rule", l)
+	if out, err := exec.CommandContext(ctx, "/sbin/ebtables", "--append", "VMS", "--protocol", "IPv4", "--source", l.MAC().String(), "--ip-src", l.IP.String(), "--in-interface", l.VEth(), "--jump", "ACCEPT").CombinedOutput(); err != nil {
+		rb.Run()
+		return virt.CommandError(fmt.Sprintf("ebtables rule addition for %s", l), err, out)
+	}
+	rb.Add(func() {
+		if out, err := exec.CommandContext(ctx, "/sbin/ebtables", "--delete", "VMS", "--protocol", "IPv4", "--source", l.MAC().String(), "--ip-src", l.IP.String(), "--in-interface", l.VEth(), "--jump", "ACCEPT").CombinedOutput(); err != nil {
+			glog.Errorf("%s: rollback ebtables rule: %v", l, virt.CommandError("ebtables rule deletion failed", err, out))
+		}
+	})
+
+	// add a static route so it is redistributed by BGP
+	glog.V(1).Infof("%s: adding static route", l)
+	if out, err := exec.CommandContext(ctx, "/sbin/route", "add", l.IP.String(), "lxcbr0").CombinedOutput(); err != nil {
+		rb.Run()
+		return virt.CommandError(fmt.Sprintf("adding route for %s", l), err, out)
+	}
+
+	return nil
+}
+
+func (l *LXC) Unprepare(ctx context.Context) error {
+	var firstError error
+
+	// stop the container
+	out, err := l.Stop(ctx)
+	if state := l.GetState(ctx); state != "STOPPED" {
+		glog.Errorf("%s: could not stop container (state=%s): %v", l, state, virt.CommandError("stop failed", err, out))
+		return fmt.Errorf("stop %s: %w", l, virt.CommandError("stop failed", err, out))
+	}
+
+	// backup dpkg database for statistical purposes
+	os.Mkdir("/var/lib/lxc/dpkg-statuses", 0755)
+	virt.CopyFile(l.OverlayFile("/var/lib/dpkg/status"), "/var/lib/lxc/dpkg-statuses/"+l.String(), virt.RootIdOffset)
+
+	// remove ebtables entry
+	if l.IP != nil {
+		if out, err := exec.CommandContext(ctx, "/sbin/ebtables", "--delete", "VMS", "--protocol", "IPv4", "--source", l.MAC().String(), "--ip-src", l.IP.String(), "--in-interface", l.VEth(), "--jump", "ACCEPT").CombinedOutput(); err != nil && firstError == nil {
+			firstError = virt.CommandError("ebtables rule deletion failed.", err, out)
+			glog.Errorf("%s: %v", l, firstError)
+		}
+	}
+
+	// remove the static route so it is no longer redistribed by BGP
+	if out, err := exec.CommandContext(ctx, "/sbin/route", "del", l.IP.String(), "lxcbr0").CombinedOutput(); err != nil {
+		firstError = virt.CommandError("removing route failed.", err, out)
+		glog.Errorf("%s: %v", l, firstError)
+	}
+
+	// unmount and unmap everything
+	if out, err := exec.CommandContext(ctx, "/bin/umount", l.PtsDir()).CombinedOutput(); err != nil && firstError == nil {
+		firstError = virt.CommandError("umount devpts failed.", err, out)
+		glog.Errorf("%s: %v", l, firstError)
+	}
+	if out, err := exec.CommandContext(ctx, "/bin/umount", l.File("rootfs")).CombinedOutput(); err != nil && firstError == nil {
+		firstError = virt.CommandError("umount overlay failed.", err, out)
+		glog.Errorf("%s: %v", l, firstError)
+	}
+	if out, err := exec.CommandContext(ctx, "/bin/umount", l.OverlayFile("")).CombinedOutput(); err != nil && firstError == nil {
+		firstError = virt.CommandError("umount rbd failed.", err, out)
+		glog.Errorf("%s: %v", l, firstError)
+	}
+	if out, err := exec.CommandContext(ctx, "/usr/bin/rbd", "unmap", l.RbdDevice()).CombinedOutput(); err != nil && firstError == nil {
+		firstError = virt.CommandError("rbd unmap failed.", err, out)
+		glog.Errorf("%s: %v", l, firstError)
+	}
+
+	// remove VM directory
+	os.Remove(l.File("config"))
+	os.Remove(l.File("fstab"))
+	os.Remove(l.File("rootfs"))
+	os.Remove(l.File("rootfs.hold"))
+	os.Remove(l.OverlayFile("/"))
+	os.Remove(l.File(""))
+
+	return firstError
+}
+
+func (l *LXC) Start(ctx context.Context) (out []byte, err error) {
+	return exec.CommandContext(ctx, "/usr/bin/lxc-start", "-d", "-n", l.String()).CombinedOutput()
+}
+
+func (l *LXC) Stop(ctx context.Context) (out []byte, err error) {
+	return exec.CommandContext(ctx, "/usr/bin/lxc-stop", "-n", l.String()).CombinedOutput()
+}
+
+func (l *LXC) GetState(ctx context.Context) string {
+	out, err := exec.CommandContext(ctx, "/usr/bin/lxc-info", "-n", l.String(), "-s").CombinedOutput()
+	if err != nil {
+		return "UNKNOWN"
+	}
+
+	// lxc-info -s prints a single line: "state: RUNNING"
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		return "UNKNOWN"
+	}
+	return fields[1]
+}
+
+const FIFREEZE = 0xC0045877
+const FITHAW = 0xC0045878
+
+func (l *LXC) FreezeFileSystem() error {
+	return l.controlOverlay(FIFREEZE)
+}
+
+func (l *LXC) ThawFileSystem() error {
+	return l.controlOverlay(FITHAW)
+}
+
+func (l *LXC) controlOverlay(action uintptr) error {
+	fd, err := os.Open(l.OverlayFile(""))
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd.Fd(), action, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (l *LXC) CreateConsistentSnapshot(ctx context.Context, snapshotName string) error {
+	if err := l.FreezeFileSystem(); err != nil {
+		return err
+	}
+	defer l.ThawFileSystem()
+	if out, err := exec.CommandContext(ctx, "rbd", "snap", "create", "--pool", "vms", "--image", l.String(), "--snap", snapshotName).CombinedOutput(); err != nil {
+		return virt.CommandError("Creating snapshot failed.", err, out)
+	}
+	return nil
+}
+
+func (l *LXC) generateFile(p, tmpl string, id int, executable bool) error {
+	var mode os.FileMode = 0644
+	if executable {
+		mode = 0755
+	}
+	file, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", p, err)
+	}
+	defer file.Close()
+
+	if err := virt.ExecuteTemplate(file, tmpl, l.Common); err != nil {
+		return fmt.Errorf("render template %s into %s: %w", tmpl, p, err)
+	}
+
+	return virt.Chown(p, id, id)
+}
@@ -0,0 +1,42 @@
+package drivers
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+
+	"koding/virt"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// TestLXCPrepareRollsBackOnFailure injects a failure at the first stage
+// past directory creation (rendering the "config" template, which is
+// never loaded in this test) and asserts that prepare cleans up the
+// base directory it had already created instead of leaving it behind.
+func TestLXCPrepareRollsBackOnFailure(t *testing.T) {
+	root, err := os.MkdirTemp("", "lxc-root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	orig := virt.LXCRoot
+	virt.LXCRoot = root
+	defer func() { virt.LXCRoot = orig }()
+
+	l := &LXC{&virt.Common{
+		Id:   bson.NewObjectId(),
+		Name: "test",
+		IP:   net.ParseIP("10.0.0.1"),
+	}}
+
+	if err := l.prepare(context.Background(), nil, false); err == nil {
+		t.Fatal("expected prepare to fail with no templates loaded")
+	}
+
+	if _, err := os.Stat(l.File("")); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be rolled back, stat returned %v", l.File(""), err)
+	}
+}
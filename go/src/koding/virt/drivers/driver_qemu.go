@@ -0,0 +1,202 @@
+package drivers
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"koding/virt"
+
+	"github.com/golang/glog"
+)
+
+func init() {
+	virt.RegisterDriver("qemu", func(c *virt.Common) virt.Instance {
+		return &QEMU{c}
+	})
+}
+
+// QEMU boots a microVM straight off the same RBD image the LXC driver
+// uses, via qemu-system-x86_64 with virtio-net (reusing the existing
+// MAC/veth/ebtables plumbing) and virtio-blk. It exists for workloads
+// that need a real kernel, such as custom modules or nested
+// virtualization, that the shared LXC image can't offer.
+type QEMU struct {
+	*virt.Common
+}
+
+func (q *QEMU) pidFile() string {
+	return q.File("qemu.pid")
+}
+
+func (q *QEMU) monitorSocket() string {
+	return q.File("qemu-monitor.sock")
+}
+
+// Prepare maps the instance's RBD image and, the first time it's used,
+// seeds it from a base QEMU disk image so the guest has something
+// bootable instead of an empty block device. That base image carries
+// its own accounts, so unlike the LXC driver — which assembles each
+// user's home directory on the host — users and reinitialize have
+// nothing to act on here; giving guest accounts the same treatment
+// would mean wiring up a cloud-init seed drive, which doesn't exist yet.
+func (q *QEMU) Prepare(ctx context.Context, users []virt.User, reinitialize bool) error {
+	if err := q.Unprepare(ctx); err != nil {
+		return fmt.Errorf("unprepare %s before prepare: %w", q, err)
+	}
+
+	var rb virt.Rollback
+
+	if _, err := virt.PrepareDir(q.File(""), 0); err != nil {
+		return fmt.Errorf("prepare %s: %w", q, err)
+	}
+	rb.Add(func() {
+		if err := os.RemoveAll(q.File("")); err != nil {
+			glog.Errorf("%s: rollback remove %s: %v", q, q.File(""), err)
+		}
+	})
+
+	// map rbd image to a block device and hand it to the guest directly
+	// as virtio-blk; unlike the LXC driver we never mount it on the host.
+	glog.V(1).Infof("%s: mapping rbd image", q)
+	created, err := q.MapRBD(ctx, false)
+	if err != nil {
+		rb.Run()
+		return fmt.Errorf("map rbd for %s: %w", q, err)
+	}
+	rb.Add(func() {
+		if out, err := exec.CommandContext(ctx, "/usr/bin/rbd", "unmap", q.RbdDevice()).CombinedOutput(); err != nil {
+			glog.Errorf("%s: rollback rbd unmap: %v", q, virt.CommandError("rbd unmap failed", err, out))
+		}
+	})
+
+	if created {
+		glog.V(1).Infof("%s: fresh disk, seeding it from the base image", q)
+		baseImage := virt.TemplateDir() + "/qemu/base.img"
+		if out, err := exec.CommandContext(ctx, "/usr/bin/qemu-img", "convert", "-O", "raw", baseImage, q.RbdDevice()).CombinedOutput(); err != nil {
+			rb.Run()
+			return virt.CommandError(fmt.Sprintf("seed disk for %s from %s", q, baseImage), err, out)
+		}
+	}
+
+	// add ebtables entry to restrict IP and MAC, same as the LXC driver
+	glog.V(1).Infof("%s: adding ebtables rule", q)
+	if out, err := exec.CommandContext(ctx, "/sbin/ebtables", "--append", "VMS", "--protocol", "IPv4", "--source", q.MAC().String(), "--ip-src", q.IP.String(), "--in-interface", q.VEth(), "--jump", "ACCEPT").CombinedOutput(); err != nil {
+		rb.Run()
+		return virt.CommandError(fmt.Sprintf("ebtables rule addition for %s", q), err, out)
+	}
+	rb.Add(func() {
+		if out, err := exec.CommandContext(ctx, "/sbin/ebtables", "--delete", "VMS", "--protocol", "IPv4", "--source", q.MAC().String(), "--ip-src", q.IP.String(), "--in-interface", q.VEth(), "--jump", "ACCEPT").CombinedOutput(); err != nil {
+			glog.Errorf("%s: rollback ebtables rule: %v", q, virt.CommandError("ebtables rule deletion failed", err, out))
+		}
+	})
+
+	// add a static route so it is redistributed by BGP
+	glog.V(1).Infof("%s: adding static route", q)
+	if out, err := exec.CommandContext(ctx, "/sbin/route", "add", q.IP.String(), "lxcbr0").CombinedOutput(); err != nil {
+		rb.Run()
+		return virt.CommandError(fmt.Sprintf("adding route for %s", q), err, out)
+	}
+
+	return nil
+}
+
+func (q *QEMU) Unprepare(ctx context.Context) error {
+	var firstError error
+
+	out, err := q.Stop(ctx)
+	if state := q.GetState(ctx); state != "STOPPED" {
+		glog.Errorf("%s: could not stop microVM (state=%s): %v", q, state, virt.CommandError("stop failed", err, out))
+		return fmt.Errorf("stop %s: %w", q, virt.CommandError("stop failed", err, out))
+	}
+
+	if q.IP != nil {
+		if out, err := exec.CommandContext(ctx, "/sbin/ebtables", "--delete", "VMS", "--protocol", "IPv4", "--source", q.MAC().String(), "--ip-src", q.IP.String(), "--in-interface", q.VEth(), "--jump", "ACCEPT").CombinedOutput(); err != nil && firstError == nil {
+			firstError = virt.CommandError("ebtables rule deletion failed.", err, out)
+			glog.Errorf("%s: %v", q, firstError)
+		}
+	}
+
+	if out, err := exec.CommandContext(ctx, "/sbin/route", "del", q.IP.String(), "lxcbr0").CombinedOutput(); err != nil {
+		firstError = virt.CommandError("removing route failed.", err, out)
+		glog.Errorf("%s: %v", q, firstError)
+	}
+
+	if out, err := exec.CommandContext(ctx, "/usr/bin/rbd", "unmap", q.RbdDevice()).CombinedOutput(); err != nil && firstError == nil {
+		firstError = virt.CommandError("rbd unmap failed.", err, out)
+		glog.Errorf("%s: %v", q, firstError)
+	}
+
+	os.Remove(q.pidFile())
+	os.Remove(q.monitorSocket())
+	os.Remove(q.File(""))
+
+	return firstError
+}
+
+func (q *QEMU) Start(ctx context.Context) (out []byte, err error) {
+	args := []string{
+		"-name", q.String(),
+		"-m", "1024",
+		"-enable-kvm",
+		"-daemonize",
+		"-pidfile", q.pidFile(),
+		"-monitor", "unix:" + q.monitorSocket() + ",server,nowait",
+		"-drive", fmt.Sprintf("file=%s,if=virtio,format=raw", q.RbdDevice()),
+		"-net", "nic,model=virtio,macaddr=" + q.MAC().String(),
+		"-net", "tap,ifname=" + q.VEth() + ",script=no,downscript=no",
+	}
+	return exec.CommandContext(ctx, "/usr/bin/qemu-system-x86_64", args...).CombinedOutput()
+}
+
+func (q *QEMU) Stop(ctx context.Context) (out []byte, err error) {
+	pid, err := q.readPid()
+	if err != nil {
+		// nothing to stop
+		return nil, nil
+	}
+	return nil, exec.CommandContext(ctx, "/bin/kill", strconv.Itoa(pid)).Run()
+}
+
+func (q *QEMU) GetState(ctx context.Context) string {
+	if _, err := q.readPid(); err != nil {
+		return "STOPPED"
+	}
+	return "RUNNING"
+}
+
+func (q *QEMU) readPid() (int, error) {
+	data, err := ioutil.ReadFile(q.pidFile())
+	if err != nil {
+		return 0, err
+	}
+	// qemu writes the pid followed by a newline
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// FreezeFileSystem and ThawFileSystem would need a guest agent (qemu-ga)
+// to quiesce the filesystem inside the VM; until that's wired up,
+// snapshots of QEMU instances are crash-consistent rather than
+// filesystem-consistent.
+func (q *QEMU) FreezeFileSystem() error {
+	return nil
+}
+
+func (q *QEMU) ThawFileSystem() error {
+	return nil
+}
+
+func (q *QEMU) CreateConsistentSnapshot(ctx context.Context, snapshotName string) error {
+	if err := q.FreezeFileSystem(); err != nil {
+		return err
+	}
+	defer q.ThawFileSystem()
+	if out, err := exec.CommandContext(ctx, "rbd", "snap", "create", "--pool", "vms", "--image", q.String(), "--snap", snapshotName).CombinedOutput(); err != nil {
+		return virt.CommandError("Creating snapshot failed.", err, out)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package virt
+
+import (
+	"context"
+	"fmt"
+)
+
+// Instance is implemented by every VM backend Koding can prepare and run
+// a user's environment on, such as the LXC container driver or the
+// QEMU/KVM driver. Callers only ever talk to the interface, so switching
+// a VM between backends is a matter of changing its Common.DBType.
+//
+// Every method that shells out takes a context so HTTP handlers can
+// enforce deadlines on what would otherwise be unbounded container
+// bring-up or teardown.
+type Instance interface {
+	Prepare(ctx context.Context, users []User, reinitialize bool) error
+	Unprepare(ctx context.Context) error
+
+	Start(ctx context.Context) (out []byte, err error)
+	Stop(ctx context.Context) (out []byte, err error)
+	GetState(ctx context.Context) string
+
+	CreateConsistentSnapshot(ctx context.Context, snapshotName string) error
+	FreezeFileSystem() error
+	ThawFileSystem() error
+
+	ListSnapshots(ctx context.Context) ([]Snapshot, error)
+	DeleteSnapshot(ctx context.Context, name string) error
+	RollbackSnapshot(ctx context.Context, name string) error
+	PruneSnapshots(ctx context.Context, opts SnapshotPruneOptions) (PruneReport, error)
+}
+
+// Driver constructs the Instance for a given dbType around the provided
+// Common fields.
+type Driver func(*Common) Instance
+
+var drivers = map[string]Driver{}
+
+// RegisterDriver makes a driver available under dbType for Load to use.
+// Drivers call this from an init() function, the same way database/sql
+// drivers register themselves.
+func RegisterDriver(dbType string, driver Driver) {
+	drivers[dbType] = driver
+}
+
+// Load looks up the driver selected by c.DBType and returns the Instance
+// wrapping c. VMs with no DBType set default to "lxc" for backward
+// compatibility with documents written before drivers existed. If c
+// opts into scheduled snapshot pruning via SnapshotPruning, Load also
+// starts a RunSnapshotPruner goroutine for it that runs for as long as
+// the process does.
+func Load(c *Common) (Instance, error) {
+	dbType := c.DBType
+	if dbType == "" {
+		dbType = "lxc"
+	}
+
+	driver, ok := drivers[dbType]
+	if !ok {
+		return nil, fmt.Errorf("virt: no driver registered for dbType %q", dbType)
+	}
+
+	instance := driver(c)
+
+	if c.SnapshotPruning != nil {
+		go c.RunSnapshotPruner(context.Background(), c.SnapshotPruning.Interval, c.SnapshotPruning.Options)
+	}
+
+	return instance, nil
+}
@@ -0,0 +1,79 @@
+package virt
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// MapRBD maps the instance's RBD image to a local block device, creating
+// the backing image the first time around. It is shared by every driver
+// since both the LXC and QEMU backends boot from the same RBD image,
+// just attach it differently.
+//
+// formatFS controls what a freshly created image is initialized with:
+// the LXC driver passes true to get an ext4 filesystem it can mount and
+// populate directly, while the QEMU driver passes false since it boots
+// the image as a raw disk and seeds it with a base image instead.
+//
+// created reports whether the image was just created by this call, so
+// callers know whether the volume still needs seeding. It returns a
+// wrapped error rather than panicking, and a canceled ctx is returned as
+// ctx.Err() instead of blocking forever on a device that will never
+// appear.
+func (c *Common) MapRBD(ctx context.Context, formatFS bool) (created bool, err error) {
+	glog.V(1).Infof("%s: mapping rbd image", c)
+	if err := exec.CommandContext(ctx, "/usr/bin/rbd", "map", "--pool", "vms", "--image", c.String()).Run(); err != nil {
+		exitError, isExitError := err.(*exec.ExitError)
+		if !isExitError || exitError.Sys().(syscall.WaitStatus).ExitStatus() != 1 {
+			glog.Errorf("%s: rbd map: %v", c, err)
+			return false, fmt.Errorf("rbd map %s: %w", c, err)
+		}
+
+		// image doesn't exist yet: create it and map again
+		glog.V(1).Infof("%s: image missing, creating it", c)
+		if out, err := exec.CommandContext(ctx, "/usr/bin/rbd", "create", "--pool", "vms", "--size", "1200", "--image", c.String()).CombinedOutput(); err != nil {
+			glog.Errorf("%s: rbd create: %v", c, err)
+			return false, CommandError(fmt.Sprintf("rbd create %s", c), err, out)
+		}
+		if out, err := exec.CommandContext(ctx, "/usr/bin/rbd", "map", "--pool", "vms", "--image", c.String()).CombinedOutput(); err != nil {
+			glog.Errorf("%s: rbd map (after create): %v", c, err)
+			return false, CommandError(fmt.Sprintf("rbd map %s", c), err, out)
+		}
+
+		created = true
+	}
+
+	// wait for rbd device to appear, without sleeping past ctx's deadline
+	ticker := time.NewTicker(time.Second / 2)
+	defer ticker.Stop()
+	for {
+		if _, err := os.Stat(c.RbdDevice()); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			glog.Errorf("%s: stat %s: %v", c, c.RbdDevice(), err)
+			return created, fmt.Errorf("stat %s: %w", c.RbdDevice(), err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return created, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	if created && formatFS {
+		glog.V(1).Infof("%s: formatting %s as ext4", c, c.RbdDevice())
+		if out, err := exec.CommandContext(ctx, "/sbin/mkfs.ext4", c.RbdDevice()).CombinedOutput(); err != nil {
+			glog.Errorf("%s: mkfs.ext4: %v", c, err)
+			return created, CommandError(fmt.Sprintf("mkfs.ext4 %s", c.RbdDevice()), err, out)
+		}
+	}
+
+	return created, nil
+}
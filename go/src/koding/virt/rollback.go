@@ -0,0 +1,21 @@
+package virt
+
+// Rollback collects cleanup steps as a multi-stage operation completes
+// each one, so the operation can undo exactly the steps that succeeded
+// if a later one fails. Steps run in reverse (LIFO) order, mirroring how
+// Unprepare tears things down.
+type Rollback struct {
+	steps []func()
+}
+
+// Add records step to be undone, should Run ever be called.
+func (r *Rollback) Add(step func()) {
+	r.steps = append(r.steps, step)
+}
+
+// Run undoes every recorded step, most recently added first.
+func (r *Rollback) Run() {
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		r.steps[i]()
+	}
+}
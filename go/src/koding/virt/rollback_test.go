@@ -0,0 +1,39 @@
+package virt
+
+import "testing"
+
+func TestRollbackRunsStepsInReverseOrder(t *testing.T) {
+	var order []int
+	var rb Rollback
+	rb.Add(func() { order = append(order, 1) })
+	rb.Add(func() { order = append(order, 2) })
+	rb.Add(func() { order = append(order, 3) })
+
+	rb.Run()
+
+	want := []int{3, 2, 1}
+	if len(order) != len(want) {
+		t.Fatalf("Run() produced %v, want %v", order, want)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("Run() produced %v, want %v", order, want)
+		}
+	}
+}
+
+func TestRollbackWithNoStepsIsNoop(t *testing.T) {
+	var rb Rollback
+	rb.Run()
+}
+
+func TestRollbackOnlyUndoesRecordedSteps(t *testing.T) {
+	ran := 0
+	var rb Rollback
+	rb.Add(func() { ran++ })
+
+	rb.Run()
+	if ran != 1 {
+		t.Fatalf("expected the single recorded step to run once, ran %d times", ran)
+	}
+}
@@ -0,0 +1,230 @@
+package virt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Snapshot describes one RBD snapshot of an instance's backing image.
+type Snapshot struct {
+	Name      string
+	CreatedAt time.Time
+	Size      uint64
+}
+
+// SnapshotPruneOptions controls which snapshots PruneSnapshots removes,
+// modeled on the shape of Docker's BuildCachePrune options.
+type SnapshotPruneOptions struct {
+	// KeepLast keeps the KeepLast most recent snapshots regardless of age.
+	KeepLast int
+	// KeepWithin keeps every snapshot created within this long of now.
+	KeepWithin time.Duration
+	// Filters restricts pruning to snapshots matching every key, e.g.
+	// {"prefix": "auto-"}. Only two keys are recognised: "prefix" (the
+	// name starts with the value) and "label" (the name contains the
+	// value); any other key is ignored.
+	Filters map[string]string
+}
+
+// PruneReport summarizes what PruneSnapshots removed.
+type PruneReport struct {
+	SnapshotsDeleted []string
+	SpaceReclaimed   uint64
+}
+
+type rbdSnapListEntry struct {
+	Id        int64  `json:"id"`
+	Name      string `json:"name"`
+	Size      uint64 `json:"size"`
+	Timestamp string `json:"timestamp"`
+}
+
+// rbdTimestampLayout matches the ctime-style string rbd emits for a
+// snapshot's timestamp field, e.g. "Sun Jul 26 03:54:00 2026".
+const rbdTimestampLayout = "Mon Jan 2 15:04:05 2006"
+
+// ListSnapshots lists the RBD snapshots of the instance's backing image.
+func (c *Common) ListSnapshots(ctx context.Context) ([]Snapshot, error) {
+	out, err := exec.CommandContext(ctx, "rbd", "snap", "ls", "--pool", "vms", "--image", c.String(), "--format", "json").CombinedOutput()
+	if err != nil {
+		return nil, CommandError(fmt.Sprintf("list snapshots for %s", c), err, out)
+	}
+
+	var entries []rbdSnapListEntry
+	if err := json.Unmarshal(out, &entries); err != nil {
+		return nil, fmt.Errorf("parse rbd snap ls output for %s: %w", c, err)
+	}
+
+	snaps := make([]Snapshot, len(entries))
+	for i, e := range entries {
+		snap := Snapshot{Name: e.Name, Size: e.Size}
+		if t, err := time.Parse(rbdTimestampLayout, e.Timestamp); err == nil {
+			snap.CreatedAt = t
+		}
+		snaps[i] = snap
+	}
+	return snaps, nil
+}
+
+// DeleteSnapshot removes a single named snapshot of the instance's
+// backing image.
+func (c *Common) DeleteSnapshot(ctx context.Context, name string) error {
+	if out, err := exec.CommandContext(ctx, "rbd", "snap", "rm", "--pool", "vms", "--image", c.String(), "--snap", name).CombinedOutput(); err != nil {
+		return CommandError(fmt.Sprintf("delete snapshot %s of %s", name, c), err, out)
+	}
+	return nil
+}
+
+// RollbackSnapshot restores the instance's backing image to the state
+// it was in when name was created.
+func (c *Common) RollbackSnapshot(ctx context.Context, name string) error {
+	if out, err := exec.CommandContext(ctx, "rbd", "snap", "rollback", "--pool", "vms", "--image", c.String(), "--snap", name).CombinedOutput(); err != nil {
+		return CommandError(fmt.Sprintf("rollback %s to snapshot %s", c, name), err, out)
+	}
+	return nil
+}
+
+// PruneSnapshots deletes the snapshots opts says are safe to discard and
+// reports what it reclaimed, so long-lived VMs don't accumulate
+// thousands of RBD snapshots.
+func (c *Common) PruneSnapshots(ctx context.Context, opts SnapshotPruneOptions) (PruneReport, error) {
+	snaps, err := c.ListSnapshots(ctx)
+	if err != nil {
+		return PruneReport{}, err
+	}
+
+	candidates := selectPruneCandidates(time.Now(), snaps, opts)
+
+	var report PruneReport
+	for _, s := range candidates {
+		used, err := c.snapshotDiskUsage(ctx, s.Name)
+		if err != nil {
+			glog.Errorf("%s: measuring disk usage of snapshot %s: %v", c, s.Name, err)
+		}
+		if err := c.DeleteSnapshot(ctx, s.Name); err != nil {
+			glog.Errorf("%s: pruning snapshot %s: %v", c, s.Name, err)
+			continue
+		}
+
+		report.SnapshotsDeleted = append(report.SnapshotsDeleted, s.Name)
+		report.SpaceReclaimed += used
+	}
+
+	return report, nil
+}
+
+// selectPruneCandidates applies opts against snaps and returns the
+// snapshots that are safe to delete, oldest first. now is passed in
+// rather than read via time.Now() so KeepWithin's cutoff is deterministic
+// in tests.
+func selectPruneCandidates(now time.Time, snaps []Snapshot, opts SnapshotPruneOptions) []Snapshot {
+	candidates := make([]Snapshot, 0, len(snaps))
+	for _, s := range snaps {
+		if matchesFilters(s, opts.Filters) {
+			candidates = append(candidates, s)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].CreatedAt.Before(candidates[j].CreatedAt)
+	})
+
+	keep := make(map[string]bool, len(candidates))
+	if opts.KeepLast > 0 {
+		from := len(candidates) - opts.KeepLast
+		if from < 0 {
+			from = 0
+		}
+		for _, s := range candidates[from:] {
+			keep[s.Name] = true
+		}
+	}
+	if opts.KeepWithin > 0 {
+		cutoff := now.Add(-opts.KeepWithin)
+		for _, s := range candidates {
+			if s.CreatedAt.After(cutoff) {
+				keep[s.Name] = true
+			}
+		}
+	}
+
+	prune := make([]Snapshot, 0, len(candidates))
+	for _, s := range candidates {
+		if !keep[s.Name] {
+			prune = append(prune, s)
+		}
+	}
+	return prune
+}
+
+func matchesFilters(s Snapshot, filters map[string]string) bool {
+	if prefix, ok := filters["prefix"]; ok && !strings.HasPrefix(s.Name, prefix) {
+		return false
+	}
+	if label, ok := filters["label"]; ok && !strings.Contains(s.Name, label) {
+		return false
+	}
+	return true
+}
+
+func (c *Common) snapshotDiskUsage(ctx context.Context, snap string) (uint64, error) {
+	out, err := exec.CommandContext(ctx, "rbd", "du", "--pool", "vms", "--image", c.String(), "--snap", snap, "--format", "json").CombinedOutput()
+	if err != nil {
+		return 0, CommandError(fmt.Sprintf("rbd du for %s@%s", c, snap), err, out)
+	}
+
+	var result struct {
+		Images []struct {
+			Snapshot string `json:"snapshot"`
+			UsedSize uint64 `json:"used_size"`
+		} `json:"images"`
+	}
+	if err := json.Unmarshal(out, &result); err != nil {
+		return 0, fmt.Errorf("parse rbd du output for %s@%s: %w", c, snap, err)
+	}
+	for _, img := range result.Images {
+		if img.Snapshot == snap {
+			return img.UsedSize, nil
+		}
+	}
+	return 0, nil
+}
+
+// SnapshotPruneConfig opts a VM into periodic, automatic snapshot
+// pruning; see Common.SnapshotPruning.
+type SnapshotPruneConfig struct {
+	Interval time.Duration
+	Options  SnapshotPruneOptions
+}
+
+// RunSnapshotPruner calls PruneSnapshots every interval until ctx is
+// canceled. Load starts it for VMs whose config enables scheduled
+// pruning via Common.SnapshotPruning; most Koding VMs are short-lived
+// and never accumulate enough snapshots to need it, so it stays off by
+// default.
+func (c *Common) RunSnapshotPruner(ctx context.Context, interval time.Duration, opts SnapshotPruneOptions) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := c.PruneSnapshots(ctx, opts)
+			if err != nil {
+				glog.Errorf("%s: snapshot prune: %v", c, err)
+				continue
+			}
+			if len(report.SnapshotsDeleted) > 0 {
+				glog.V(1).Infof("%s: pruned %d snapshots, reclaimed %d bytes", c, len(report.SnapshotsDeleted), report.SpaceReclaimed)
+			}
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package virt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMatchesFiltersPrefix(t *testing.T) {
+	s := Snapshot{Name: "auto-2026-07-26"}
+
+	if !matchesFilters(s, map[string]string{"prefix": "auto-"}) {
+		t.Errorf("expected %q to match prefix filter", s.Name)
+	}
+	if matchesFilters(s, map[string]string{"prefix": "manual-"}) {
+		t.Errorf("expected %q not to match prefix filter", s.Name)
+	}
+}
+
+func TestMatchesFiltersNoFiltersMatchesEverything(t *testing.T) {
+	s := Snapshot{Name: "whatever"}
+
+	if !matchesFilters(s, nil) {
+		t.Errorf("expected no filters to match everything")
+	}
+}
+
+func snapAt(name string, hoursAgo int) Snapshot {
+	return Snapshot{Name: name, CreatedAt: time.Date(2026, 7, 26, 12, 0, 0, 0, time.UTC).Add(-time.Duration(hoursAgo) * time.Hour)}
+}
+
+func pruneNames(snaps []Snapshot) []string {
+	names := make([]string, len(snaps))
+	for i, s := range snaps {
+		names[i] = s.Name
+	}
+	return names
+}
+
+func assertNames(t *testing.T, got []Snapshot, want []string) {
+	t.Helper()
+	gotNames := pruneNames(got)
+	if len(gotNames) != len(want) {
+		t.Fatalf("got %v, want %v", gotNames, want)
+	}
+	for i := range want {
+		if gotNames[i] != want[i] {
+			t.Fatalf("got %v, want %v", gotNames, want)
+		}
+	}
+}
+
+func TestSelectPruneCandidatesKeepLastKeepsMostRecent(t *testing.T) {
+	now := time.Date(2026, 7, 26, 12, 0, 0, 0, time.UTC)
+	snaps := []Snapshot{
+		snapAt("oldest", 72),
+		snapAt("middle", 48),
+		snapAt("newest", 24),
+	}
+
+	pruned := selectPruneCandidates(now, snaps, SnapshotPruneOptions{KeepLast: 1})
+
+	assertNames(t, pruned, []string{"oldest", "middle"})
+}
+
+func TestSelectPruneCandidatesKeepLastGreaterThanCountKeepsAll(t *testing.T) {
+	now := time.Date(2026, 7, 26, 12, 0, 0, 0, time.UTC)
+	snaps := []Snapshot{snapAt("a", 2), snapAt("b", 1)}
+
+	pruned := selectPruneCandidates(now, snaps, SnapshotPruneOptions{KeepLast: 10})
+
+	assertNames(t, pruned, nil)
+}
+
+func TestSelectPruneCandidatesKeepWithinKeepsRecentOnes(t *testing.T) {
+	now := time.Date(2026, 7, 26, 12, 0, 0, 0, time.UTC)
+	snaps := []Snapshot{
+		snapAt("old", 48),
+		snapAt("recent", 1),
+	}
+
+	pruned := selectPruneCandidates(now, snaps, SnapshotPruneOptions{KeepWithin: 24 * time.Hour})
+
+	assertNames(t, pruned, []string{"old"})
+}
+
+func TestSelectPruneCandidatesKeepLastAndKeepWithinUnion(t *testing.T) {
+	now := time.Date(2026, 7, 26, 12, 0, 0, 0, time.UTC)
+	snaps := []Snapshot{
+		snapAt("ancient", 96),
+		snapAt("old", 48),
+		snapAt("recent", 1),
+	}
+
+	// KeepLast=1 alone would keep only "recent". KeepWithin=72h alone
+	// would keep "old" and "recent" too. The two combine as a union, not
+	// an intersection, so only "ancient" ends up pruned.
+	pruned := selectPruneCandidates(now, snaps, SnapshotPruneOptions{KeepLast: 1, KeepWithin: 72 * time.Hour})
+
+	assertNames(t, pruned, []string{"ancient"})
+}
+
+func TestSelectPruneCandidatesRespectsFilters(t *testing.T) {
+	now := time.Date(2026, 7, 26, 12, 0, 0, 0, time.UTC)
+	snaps := []Snapshot{
+		{Name: "auto-old", CreatedAt: now.Add(-48 * time.Hour)},
+		{Name: "manual-old", CreatedAt: now.Add(-48 * time.Hour)},
+	}
+
+	pruned := selectPruneCandidates(now, snaps, SnapshotPruneOptions{Filters: map[string]string{"prefix": "auto-"}})
+
+	assertNames(t, pruned, []string{"auto-old"})
+}
+
+func TestSelectPruneCandidatesWithNoOptionsPrunesEverything(t *testing.T) {
+	now := time.Date(2026, 7, 26, 12, 0, 0, 0, time.UTC)
+	snaps := []Snapshot{snapAt("a", 2), snapAt("b", 1)}
+
+	pruned := selectPruneCandidates(now, snaps, SnapshotPruneOptions{})
+
+	assertNames(t, pruned, []string{"a", "b"})
+}
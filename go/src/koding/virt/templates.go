@@ -0,0 +1,53 @@
+package virt
+
+import (
+	"io"
+	"net"
+	"text/template"
+)
+
+var templateDir string
+var templates = template.New("lxc")
+
+// LoadTemplates parses the config templates under dir/lxc (hostname,
+// hosts, fstab, lxc config, ...) so drivers can later render them
+// through ExecuteTemplate. The default website skeleton under
+// dir/website is not parsed; drivers copy it as is via TemplateDir.
+func LoadTemplates(dir string) error {
+	interf, err := net.InterfaceByName("lxcbr0")
+	if err != nil {
+		return err
+	}
+	addrs, err := interf.Addrs()
+	if err != nil {
+		return err
+	}
+	hostIP, _, err := net.ParseCIDR(addrs[0].String())
+	if err != nil {
+		return err
+	}
+
+	templateDir = dir
+	templates.Funcs(template.FuncMap{
+		"hostIP": func() string { return hostIP.String() },
+	})
+	if _, err := templates.ParseGlob(templateDir + "/lxc/*"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// TemplateDir returns the directory LoadTemplates was last called with,
+// for drivers that need to read other files from it (e.g. the website
+// skeleton copied into new home directories).
+func TemplateDir() string {
+	return templateDir
+}
+
+// ExecuteTemplate renders the named template against data. Drivers use
+// it to generate the files they write into a VM's root (config, fstab,
+// /etc/hostname, ...).
+func ExecuteTemplate(w io.Writer, name string, data interface{}) error {
+	return templates.ExecuteTemplate(w, name, data)
+}
@@ -0,0 +1,73 @@
+package virt
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/golang/glog"
+)
+
+func CommandError(message string, err error, out []byte) error {
+	if len(out) == 0 {
+		return fmt.Errorf("%s: %w", message, err)
+	}
+	return fmt.Errorf("%s: %w\n%s", message, err, string(out))
+}
+
+// PrepareDir creates p owned by id:id, tolerating it already existing.
+// It reports whether it actually created the directory.
+func PrepareDir(p string, id int) (bool, error) {
+	created := true
+	if err := os.Mkdir(p, 0755); err != nil {
+		if !os.IsExist(err) {
+			glog.Errorf("mkdir %s: %v", p, err)
+			return false, fmt.Errorf("mkdir %s: %w", p, err)
+		}
+		created = false
+	}
+
+	if err := Chown(p, id, id); err != nil {
+		return created, err
+	}
+
+	glog.V(1).Infof("prepared dir %s (created=%t)", p, created)
+	return created, nil
+}
+
+func Chown(p string, uid, gid int) error {
+	if err := os.Chown(p, uid, gid); err != nil {
+		glog.Errorf("chown %s to %d:%d: %v", p, uid, gid, err)
+		return fmt.Errorf("chown %s: %w", p, err)
+	}
+	return nil
+}
+
+func CopyFile(src, dst string, id int) error {
+	sf, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", src, err)
+	}
+	defer sf.Close()
+
+	fi, err := sf.Stat()
+	if err != nil {
+		return fmt.Errorf("stat %s: %w", src, err)
+	}
+
+	df, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode())
+	if err != nil {
+		return fmt.Errorf("open %s: %w", dst, err)
+	}
+	defer df.Close()
+
+	if _, err := io.Copy(df, sf); err != nil {
+		return fmt.Errorf("copy %s to %s: %w", src, dst, err)
+	}
+
+	if err := df.Chown(id, id); err != nil {
+		return fmt.Errorf("chown %s: %w", dst, err)
+	}
+
+	return nil
+}